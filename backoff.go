@@ -0,0 +1,72 @@
+package kasper
+
+import "time"
+
+// simpleBackoff is an exponential backoff with a cap, resettable on
+// success. It is not safe for concurrent use; each partitionProcessor owns
+// its own instance.
+type simpleBackoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// newSimpleBackoff creates a simpleBackoff that starts at initial and
+// doubles on every call to Duration(), up to max.
+func newSimpleBackoff(initial time.Duration, max time.Duration) *simpleBackoff {
+	return &simpleBackoff{
+		initial: initial,
+		max:     max,
+		current: 0,
+	}
+}
+
+// Duration returns how long to wait before the next retry, then doubles the
+// backoff for the following call.
+func (b *simpleBackoff) Duration() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+	}
+	duration := b.current
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return duration
+}
+
+// Reset clears the backoff back to its initial state. Call it after a
+// successful operation so the next failure starts from initial again.
+func (b *simpleBackoff) Reset() {
+	b.current = 0
+}
+
+// ProcessorErrorAction tells a partitionProcessor how to proceed after a
+// MessageProcessor.Process error or a downstream producer/store error.
+type ProcessorErrorAction int
+
+const (
+	// Retry retries the same message after backing off.
+	Retry ProcessorErrorAction = iota
+	// Skip drops the message and moves on to the next one.
+	Skip
+	// Fail reports err to Run over TopicProcessor's fatalErrors channel,
+	// which stops Run and therefore the whole TopicProcessor, the same way
+	// an unhandled error used to via log.Fatal — except the process keeps
+	// running and it's Run's caller that observes the returned error and
+	// decides how to shut down, rather than the library calling os.Exit
+	// out from under the caller.
+	Fail
+)
+
+// ProcessorErrorHandler decides what a partitionProcessor should do after
+// err occurred while processing msg. The default handler, used when
+// Config.ProcessorErrorHandler is nil, always returns Fail, preserving the
+// previous fail-fast behaviour.
+type ProcessorErrorHandler func(msg IncomingMessage, err error) ProcessorErrorAction
+
+// defaultProcessorErrorHandler always fails, matching the library's
+// historical fail-fast behaviour on any processing error.
+func defaultProcessorErrorHandler(msg IncomingMessage, err error) ProcessorErrorAction {
+	return Fail
+}
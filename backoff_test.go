@@ -0,0 +1,31 @@
+package kasper
+
+import "testing"
+
+func TestSimpleBackoffDoublesUpToCap(t *testing.T) {
+	b := newSimpleBackoff(100, 350)
+
+	got := []int{}
+	for i := 0; i < 5; i++ {
+		got = append(got, int(b.Duration()))
+	}
+
+	want := []int{100, 200, 350, 350, 350}
+	for i, d := range got {
+		if d != want[i] {
+			t.Errorf("call %d: Duration() = %d, want %d", i, d, want[i])
+		}
+	}
+}
+
+func TestSimpleBackoffReset(t *testing.T) {
+	b := newSimpleBackoff(100, 1000)
+
+	b.Duration()
+	b.Duration()
+	b.Reset()
+
+	if got := b.Duration(); got != 100 {
+		t.Errorf("Duration() after Reset() = %d, want %d", got, 100)
+	}
+}
@@ -0,0 +1,255 @@
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/boltdb/bolt"
+
+	"github.com/movio/kasper/util"
+)
+
+var bucketName = []byte("kasper")
+
+// ChangelogConfig configures a BoltDBKeyValueStore to mirror every write to
+// a compacted Kafka topic, so state can be rebuilt locally after a
+// rebalance instead of round-tripping to a remote store, matching the
+// standard Kafka Streams state-store recovery contract.
+type ChangelogConfig struct {
+	Producer sarama.SyncProducer
+	Topic    string
+	// Client is used by Restore to read the changelog topic back. It is
+	// only required if Restore is called.
+	Client sarama.Client
+}
+
+var _ KeyValueStore = (*BoltDBKeyValueStore)(nil)
+
+// BoltDBKeyValueStore is a KeyValueStore backed by a local embedded BoltDB
+// file, giving a processor low-latency local state per partition instead of
+// a remote round trip on every Process call. If Changelog is configured,
+// every write is also produced to a compacted Kafka topic so the local file
+// can be rebuilt on a different host after a rebalance.
+type BoltDBKeyValueStore struct {
+	witness   *util.StructPtrWitness
+	db        *bolt.DB
+	changelog *ChangelogConfig
+}
+
+// NewBoltDBKeyValueStore creates a new BoltDBKeyValueStore backed by the
+// BoltDB file at path. StructPtr should be a pointer to the struct type
+// used for serialization and deserialization of store values.
+func NewBoltDBKeyValueStore(path string, structPtr interface{}) *BoltDBKeyValueStore {
+	return NewBoltDBKeyValueStoreWithChangelog(path, structPtr, nil)
+}
+
+// NewBoltDBKeyValueStoreWithChangelog creates a new BoltDBKeyValueStore that
+// additionally mirrors every Put/PutAll/Delete to changelog.Topic, allowing
+// the local state to be recovered on rebalance. Pass a nil changelog to get
+// a plain, non-recoverable local store.
+func NewBoltDBKeyValueStoreWithChangelog(path string, structPtr interface{}, changelog *ChangelogConfig) *BoltDBKeyValueStore {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		panic(fmt.Sprintf("Cannot open BoltDB file '%s': %s", path, err))
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		panic(fmt.Sprintf("Cannot create BoltDB bucket: %s", err))
+	}
+	return &BoltDBKeyValueStore{
+		witness:   util.NewStructPtrWitness(structPtr),
+		db:        db,
+		changelog: changelog,
+	}
+}
+
+// Get gets value by key from store.
+func (s *BoltDBKeyValueStore) Get(key string) (interface{}, error) {
+	var raw []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(bucketName).Get([]byte(key))
+		if value != nil {
+			raw = append([]byte{}, value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return s.witness.Nil(), err
+	}
+	if raw == nil {
+		return s.witness.Nil(), nil
+	}
+	structPtr := s.witness.Allocate()
+	if err := json.Unmarshal(raw, structPtr); err != nil {
+		return s.witness.Nil(), err
+	}
+	return structPtr, nil
+}
+
+// GetAll gets values for several keys from store in one transaction.
+func (s *BoltDBKeyValueStore) GetAll(keys []string) ([]*Entry, error) {
+	entries := make([]*Entry, len(keys))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		for i, key := range keys {
+			raw := bucket.Get([]byte(key))
+			if raw == nil {
+				entries[i] = &Entry{key, s.witness.Nil()}
+				continue
+			}
+			structPtr := s.witness.Allocate()
+			if err := json.Unmarshal(raw, structPtr); err != nil {
+				return err
+			}
+			entries[i] = &Entry{key, structPtr}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Put updates key in store with serialized value.
+func (s *BoltDBKeyValueStore) Put(key string, structPtr interface{}) error {
+	return s.PutAll([]*Entry{{key, structPtr}})
+}
+
+// PutAll bulk executes Put operation for several entries in one transaction,
+// mirroring each write to the changelog topic first if one is configured.
+func (s *BoltDBKeyValueStore) PutAll(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, entry := range entries {
+		s.witness.Assert(entry.Value)
+	}
+	if err := s.produceToChangelog(entries); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		for _, entry := range entries {
+			raw, err := json.Marshal(entry.Value)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(entry.Key), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes key from store.
+func (s *BoltDBKeyValueStore) Delete(key string) error {
+	if err := s.produceToChangelog([]*Entry{{key, nil}}); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Delete([]byte(key))
+	})
+}
+
+// Flush is a no-op for BoltDBKeyValueStore: every Put/PutAll/Delete is
+// already committed within its own BoltDB transaction before it returns.
+func (s *BoltDBKeyValueStore) Flush() error {
+	return nil
+}
+
+// Restore replays the changelog topic's partition for this store's assigned
+// partition into BoltDB, from the oldest available record up to the
+// partition's high water mark at the time Restore is called. It is a no-op
+// if no changelog is configured.
+//
+// BoltDBKeyValueStore satisfies kasper's restorableStore interface, so
+// listing it in Config.Stores is enough for kasper to call Restore itself
+// for every (re)assigned partition in partitionProcessorGroup.Setup, before
+// ConsumeClaim starts delivering messages for that partition - the local
+// file is rebuilt on whichever host the partition lands on next, matching
+// the standard Kafka Streams state-store recovery contract.
+func (s *BoltDBKeyValueStore) Restore(partition int32) error {
+	if s.changelog == nil {
+		return nil
+	}
+
+	newestOffset, err := s.changelog.Client.GetOffset(s.changelog.Topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return fmt.Errorf("could not get changelog high water mark for '%s/%d': %s", s.changelog.Topic, partition, err)
+	}
+	if newestOffset == 0 {
+		return nil
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(s.changelog.Client)
+	if err != nil {
+		return fmt.Errorf("could not create changelog consumer: %s", err)
+	}
+	defer consumer.Close()
+
+	partitionConsumer, err := consumer.ConsumePartition(s.changelog.Topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return fmt.Errorf("could not consume changelog '%s/%d': %s", s.changelog.Topic, partition, err)
+	}
+	defer partitionConsumer.Close()
+
+	for message := range partitionConsumer.Messages() {
+		if err := s.applyChangelogRecord(message); err != nil {
+			return err
+		}
+		if message.Offset >= newestOffset-1 {
+			break
+		}
+	}
+	return nil
+}
+
+// applyChangelogRecord replays a single changelog record into BoltDB: a nil
+// value means the original write was a Delete.
+func (s *BoltDBKeyValueStore) applyChangelogRecord(message *sarama.ConsumerMessage) error {
+	key := message.Key
+	if message.Value == nil {
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketName).Delete(key)
+		})
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Put(key, message.Value)
+	})
+}
+
+func (s *BoltDBKeyValueStore) produceToChangelog(entries []*Entry) error {
+	if s.changelog == nil {
+		return nil
+	}
+	for _, entry := range entries {
+		var raw []byte
+		if entry.Value != nil {
+			var err error
+			raw, err = json.Marshal(entry.Value)
+			if err != nil {
+				return err
+			}
+		}
+		_, _, err := s.changelog.Producer.SendMessage(&sarama.ProducerMessage{
+			Topic: s.changelog.Topic,
+			Key:   sarama.StringEncoder(entry.Key),
+			Value: sarama.ByteEncoder(raw),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to produce to changelog topic '%s': %s", s.changelog.Topic, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying BoltDB file.
+func (s *BoltDBKeyValueStore) Close() error {
+	return s.db.Close()
+}
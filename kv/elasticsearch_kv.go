@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"log"
 
@@ -36,6 +38,41 @@ type indexAndType struct {
 	indexType string
 }
 
+var _ KeyValueStore = (*ElasticsearchKeyValueStore)(nil)
+
+// ESConfig tunes the elastic.BulkProcessor that backs Put/PutAll, so
+// per-message writes are amortized into batches instead of issuing one
+// request per document.
+type ESConfig struct {
+	// BulkActions is the number of documents that triggers a flush.
+	BulkActions int
+	// BulkSize is the size in bytes that triggers a flush.
+	BulkSize int
+	// FlushInterval is the maximum time a document waits in the queue
+	// before being flushed, regardless of BulkActions/BulkSize.
+	FlushInterval time.Duration
+	// Workers is the number of concurrent bulk-request workers.
+	Workers int
+	// RetryInitialInterval and RetryMaxInterval configure the exponential
+	// backoff retrier used when ES responds with 429 or 503.
+	RetryInitialInterval time.Duration
+	RetryMaxInterval     time.Duration
+	// MetricsReporter, if set, is given the latency of every store call.
+	MetricsReporter StoreMetricsReporter
+}
+
+// DefaultESConfig returns the ESConfig used by NewESKeyValueStore.
+func DefaultESConfig() ESConfig {
+	return ESConfig{
+		BulkActions:          1000,
+		BulkSize:             5 << 20, // 5MB
+		FlushInterval:        1 * time.Second,
+		Workers:              1,
+		RetryInitialInterval: 100 * time.Millisecond,
+		RetryMaxInterval:     30 * time.Second,
+	}
+}
+
 // ElasticsearchKeyValueStore is a key-value storage that uses ElasticSearch.
 // In this key-value store, all keys must have the format "<index>/<type>/<_id>".
 type ElasticsearchKeyValueStore struct {
@@ -43,6 +80,11 @@ type ElasticsearchKeyValueStore struct {
 	client          *elastic.Client
 	context         context.Context
 	existingIndexes []indexAndType
+	bulkProcessor   *elastic.BulkProcessor
+	metrics         StoreMetricsReporter
+
+	bulkErrMu sync.Mutex
+	bulkErr   error
 }
 
 // NewESKeyValueStore creates new ElasticsearchKeyValueStore instance.
@@ -50,6 +92,14 @@ type ElasticsearchKeyValueStore struct {
 // StructPtr should be a pointer to struct type that is used.
 // for serialization and deserialization of store values.
 func NewESKeyValueStore(url string, structPtr interface{}) *ElasticsearchKeyValueStore {
+	return NewESKeyValueStoreWithConfig(url, structPtr, DefaultESConfig())
+}
+
+// NewESKeyValueStoreWithConfig creates a new ElasticsearchKeyValueStore whose
+// Put/PutAll are batched through an elastic.BulkProcessor configured by
+// config, with an exponential backoff retrier for transient 429/503
+// responses from ES.
+func NewESKeyValueStoreWithConfig(url string, structPtr interface{}, config ESConfig) *ElasticsearchKeyValueStore {
 	client, err := elastic.NewClient(
 		elastic.SetURL(url),
 		elastic.SetSniff(false), // FIXME: workaround for issues with ES in docker
@@ -57,11 +107,54 @@ func NewESKeyValueStore(url string, structPtr interface{}) *ElasticsearchKeyValu
 	if err != nil {
 		panic(fmt.Sprintf("Cannot create ElasticSearch Client to '%s': %s", url, err))
 	}
-	return &ElasticsearchKeyValueStore{
+	store := &ElasticsearchKeyValueStore{
 		witness:         util.NewStructPtrWitness(structPtr),
 		client:          client,
 		context:         context.Background(),
 		existingIndexes: nil,
+		metrics:         config.MetricsReporter,
+	}
+
+	retrier := elastic.NewBackoffRetrier(
+		elastic.NewExponentialBackoff(config.RetryInitialInterval, config.RetryMaxInterval),
+	)
+	bulkProcessor, err := client.BulkProcessor().
+		Name("kasper-es-bulk-processor").
+		Workers(config.Workers).
+		BulkActions(config.BulkActions).
+		BulkSize(config.BulkSize).
+		FlushInterval(config.FlushInterval).
+		Backoff(retrier).
+		After(store.afterBulk).
+		Do(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("Cannot start ElasticSearch bulk processor: %s", err))
+	}
+	store.bulkProcessor = bulkProcessor
+	return store
+}
+
+// afterBulk is the elastic.BulkProcessor "after" callback, invoked following
+// every commit it issues - including the automatic ones triggered by
+// BulkActions/BulkSize/FlushInterval in between explicit Flush calls. It
+// captures the first unreported error so Flush can surface it instead of a
+// background failure being silently dropped.
+func (s *ElasticsearchKeyValueStore) afterBulk(executionID int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	if err == nil && (response == nil || !response.Errors) {
+		return
+	}
+	s.bulkErrMu.Lock()
+	defer s.bulkErrMu.Unlock()
+	if s.bulkErr != nil {
+		return
+	}
+	if err != nil {
+		s.bulkErr = err
+		return
+	}
+	for _, failed := range response.Failed() {
+		s.bulkErr = fmt.Errorf("bulk request failed: index=%s type=%s id=%s: %v", failed.Index, failed.Type, failed.Id, failed.Error)
+		return
 	}
 }
 
@@ -101,6 +194,7 @@ func (s *ElasticsearchKeyValueStore) putMapping(indexName string, indexType stri
 
 // Get gets value by key from store
 func (s *ElasticsearchKeyValueStore) Get(key string) (interface{}, error) {
+	defer reportLatency(s.metrics, "elasticsearch", "Get", time.Now())
 	keyParts := strings.Split(key, "/")
 	if len(keyParts) != 3 {
 		return nil, fmt.Errorf("invalid key: '%s'", key)
@@ -139,6 +233,7 @@ func (s *ElasticsearchKeyValueStore) Get(key string) (interface{}, error) {
 
 // TBD
 func (s *ElasticsearchKeyValueStore) GetAll(keys []string) ([]*Entry, error) {
+	defer reportLatency(s.metrics, "elasticsearch", "GetAll", time.Now())
 	multiGet := s.client.MultiGet()
 	for _, key := range keys {
 		keyParts := strings.Split(key, "/")
@@ -179,35 +274,18 @@ func (s *ElasticsearchKeyValueStore) GetAll(keys []string) ([]*Entry, error) {
 	return entries, nil
 }
 
-// Put updates key in store with serialized value
+// Put updates key in store with serialized value. The write is enqueued on
+// the bulk processor rather than sent synchronously; call Flush to wait
+// until it has been committed to ES.
 func (s *ElasticsearchKeyValueStore) Put(key string, structPtr interface{}) error {
-	s.witness.Assert(structPtr)
-	keyParts := strings.Split(key, "/")
-	if len(keyParts) != 3 {
-		return fmt.Errorf("invalid key: '%s'", key)
-	}
-	indexName := keyParts[0]
-	indexType := keyParts[1]
-	valueID := keyParts[2]
-
-	s.checkOrCreateIndex(indexName, indexType)
-
-	_, err := s.client.Index().
-		Index(indexName).
-		Type(indexType).
-		Id(valueID).
-		BodyJson(structPtr).
-		Do(s.context)
-
-	return err
+	return s.PutAll([]*Entry{{key, structPtr}})
 }
 
-// PutAll bulk executes Put operation for several entries
+// PutAll enqueues a Put for each entry on the bulk processor, which batches
+// them into amortized bulk requests instead of one request per document.
+// Call Flush to wait until every enqueued write has been committed to ES.
 func (s *ElasticsearchKeyValueStore) PutAll(entries []*Entry) error {
-	if len(entries) == 0 {
-		return nil
-	}
-	bulk := s.client.Bulk()
+	defer reportLatency(s.metrics, "elasticsearch", "PutAll", time.Now())
 	for _, entry := range entries {
 		keyParts := strings.Split(entry.Key, "/")
 		if len(keyParts) != 3 {
@@ -220,19 +298,19 @@ func (s *ElasticsearchKeyValueStore) PutAll(entries []*Entry) error {
 		s.witness.Assert(entry.Value)
 		s.checkOrCreateIndex(indexName, indexType)
 
-		bulk.Add(elastic.NewBulkIndexRequest().
+		s.bulkProcessor.Add(elastic.NewBulkIndexRequest().
 			Index(indexName).
 			Type(indexType).
 			Id(valueID).
 			Doc(entry.Value),
 		)
 	}
-	_, err := bulk.Do(s.context)
-	return err
+	return nil
 }
 
 // Delete removes key from store
 func (s *ElasticsearchKeyValueStore) Delete(key string) error {
+	defer reportLatency(s.metrics, "elasticsearch", "Delete", time.Now())
 	keyParts := strings.Split(key, "/")
 	if len(keyParts) != 3 {
 		return fmt.Errorf("invalid key: '%s'", key)
@@ -256,8 +334,26 @@ func (s *ElasticsearchKeyValueStore) Delete(key string) error {
 	return err
 }
 
-// Flush the Elasticsearch translog to disk
+// Flush blocks until the bulk processor has committed every enqueued
+// Put/PutAll, returning an error if that commit - or any automatic commit
+// triggered by BulkActions/BulkSize/FlushInterval since the last Flush -
+// failed, then flushes the Elasticsearch translog to disk. This keeps
+// kasper's offset-commit path correct: a failed write is never silently
+// followed by a committed Kafka offset.
 func (s *ElasticsearchKeyValueStore) Flush() error {
+	defer reportLatency(s.metrics, "elasticsearch", "Flush", time.Now())
+	if err := s.bulkProcessor.Flush(); err != nil {
+		return err
+	}
+
+	s.bulkErrMu.Lock()
+	bulkErr := s.bulkErr
+	s.bulkErr = nil
+	s.bulkErrMu.Unlock()
+	if bulkErr != nil {
+		return bulkErr
+	}
+
 	log.Println("Flusing ES indexes...")
 	_, err := s.client.Flush("_all").
 		WaitIfOngoing(true).
@@ -0,0 +1,52 @@
+package kv
+
+import "time"
+
+// StoreMetricsReporter receives the latency of each KeyValueStore call, so
+// callers can surface per-store, per-call latency (e.g. Get vs PutAll)
+// without the kv package depending on any particular metrics library.
+type StoreMetricsReporter interface {
+	ReportStoreCallLatency(store string, call string, latency time.Duration)
+}
+
+// reportLatency is a small helper backends call via defer to time a method
+// and report it if a StoreMetricsReporter is configured.
+func reportLatency(reporter StoreMetricsReporter, store string, call string, start time.Time) {
+	if reporter == nil {
+		return
+	}
+	reporter.ReportStoreCallLatency(store, call, time.Since(start))
+}
+
+// Entry is a single key/value pair, used by the batched GetAll/PutAll
+// operations on KeyValueStore.
+type Entry struct {
+	Key   string
+	Value interface{}
+}
+
+// KeyValueStore is the common interface implemented by every kasper state
+// store backend (ElasticsearchKeyValueStore, BoltDBKeyValueStore, ...), so a
+// MessageProcessor can be written against the interface and have its
+// backing store swapped without code changes.
+type KeyValueStore interface {
+	// Get gets value by key from store. It returns the store's zero value
+	// and a nil error if the key does not exist.
+	Get(key string) (interface{}, error)
+
+	// GetAll gets values for several keys from store in one round trip.
+	GetAll(keys []string) ([]*Entry, error)
+
+	// Put updates key in store with serialized value.
+	Put(key string, structPtr interface{}) error
+
+	// PutAll bulk executes Put operation for several entries.
+	PutAll(entries []*Entry) error
+
+	// Delete removes key from store.
+	Delete(key string) error
+
+	// Flush makes sure that previous Put/PutAll/Delete calls are committed
+	// to durable storage before it returns.
+	Flush() error
+}
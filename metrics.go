@@ -0,0 +1,122 @@
+package kasper
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsReporter receives the measurements a TopicProcessor collects as it
+// runs, so users can plug in something other than the default Prometheus
+// registry.
+type MetricsReporter interface {
+	// ReportLag reports how many messages a partition is behind the
+	// broker's high water mark.
+	ReportLag(topic string, partition int32, lag int64)
+	// ReportInFlightMessageGroups reports the current count and the age of
+	// the oldest in-flight message group for a partition.
+	ReportInFlightMessageGroups(topic string, partition int32, count int, oldestAge time.Duration)
+	// ReportProduceAckLatency reports how long a produced message took to
+	// be acked by the broker.
+	ReportProduceAckLatency(topic string, latency time.Duration)
+	// ReportStoreCallLatency reports how long a KeyValueStore call took.
+	ReportStoreCallLatency(store string, call string, latency time.Duration)
+}
+
+// prometheusMetricsReporter is the default MetricsReporter, backed by a
+// dedicated prometheus.Registry so embedding a TopicProcessor never
+// collides with metrics an application registers on the global registry.
+type prometheusMetricsReporter struct {
+	registry *prometheus.Registry
+
+	lag                     *prometheus.GaugeVec
+	inFlightMessageGroups   *prometheus.GaugeVec
+	inFlightMessageGroupAge *prometheus.GaugeVec
+	produceAckLatency       *prometheus.HistogramVec
+	storeCallLatency        *prometheus.HistogramVec
+}
+
+// newPrometheusMetricsReporter creates a prometheusMetricsReporter with all
+// of its collectors registered on a fresh registry.
+func newPrometheusMetricsReporter() *prometheusMetricsReporter {
+	r := &prometheusMetricsReporter{
+		registry: prometheus.NewRegistry(),
+		lag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "kasper",
+			Name:      "consumer_lag",
+			Help:      "Number of messages a partition is behind the broker's high water mark.",
+		}, []string{"topic", "partition"}),
+		inFlightMessageGroups: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "kasper",
+			Name:      "in_flight_message_groups",
+			Help:      "Number of in-flight message groups awaiting ack for a partition.",
+		}, []string{"topic", "partition"}),
+		inFlightMessageGroupAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "kasper",
+			Name:      "in_flight_message_group_oldest_age_seconds",
+			Help:      "Age in seconds of the oldest in-flight message group for a partition.",
+		}, []string{"topic", "partition"}),
+		produceAckLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "kasper",
+			Name:      "produce_ack_latency_seconds",
+			Help:      "Latency between sending a produced message and receiving its ack.",
+		}, []string{"topic"}),
+		storeCallLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "kasper",
+			Name:      "store_call_latency_seconds",
+			Help:      "Latency of KeyValueStore calls.",
+		}, []string{"store", "call"}),
+	}
+	r.registry.MustRegister(
+		r.lag,
+		r.inFlightMessageGroups,
+		r.inFlightMessageGroupAge,
+		r.produceAckLatency,
+		r.storeCallLatency,
+	)
+	return r
+}
+
+func (r *prometheusMetricsReporter) ReportLag(topic string, partition int32, lag int64) {
+	r.lag.WithLabelValues(topic, partitionLabel(partition)).Set(float64(lag))
+}
+
+func (r *prometheusMetricsReporter) ReportInFlightMessageGroups(topic string, partition int32, count int, oldestAge time.Duration) {
+	r.inFlightMessageGroups.WithLabelValues(topic, partitionLabel(partition)).Set(float64(count))
+	r.inFlightMessageGroupAge.WithLabelValues(topic, partitionLabel(partition)).Set(oldestAge.Seconds())
+}
+
+func (r *prometheusMetricsReporter) ReportProduceAckLatency(topic string, latency time.Duration) {
+	r.produceAckLatency.WithLabelValues(topic).Observe(latency.Seconds())
+}
+
+func (r *prometheusMetricsReporter) ReportStoreCallLatency(store string, call string, latency time.Duration) {
+	r.storeCallLatency.WithLabelValues(store, call).Observe(latency.Seconds())
+}
+
+func partitionLabel(partition int32) string {
+	return strconv.Itoa(int(partition))
+}
+
+// ServeMetrics starts an HTTP server on addr exposing the default
+// prometheusMetricsReporter on /metrics and a liveness probe on /health. If
+// tp.metrics is any other MetricsReporter, it serves nothing (neither
+// /metrics nor /health) and returns nil at once. Run calls this itself in a
+// goroutine when Config.MetricsAddr is set; call it directly only if you
+// want the metrics server on a different lifecycle than Run, e.g.
+// `go tp.ServeMetrics(":9090")`.
+func (tp *TopicProcessor) ServeMetrics(addr string) error {
+	reporter, ok := tp.metrics.(*prometheusMetricsReporter)
+	if !ok {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reporter.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return http.ListenAndServe(addr, mux)
+}
@@ -1,109 +1,336 @@
 package kasper
 
 import (
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 )
 
-type partitionProcessor struct {
-	topicProcessor                 *TopicProcessor
-	coordinator                    Coordinator
-	consumer                       sarama.Consumer
-	partitionConsumers             []sarama.PartitionConsumer
-	offsetManagers                 map[string]sarama.PartitionOffsetManager
-	messageProcessor               MessageProcessor
-	inputTopics                    []string
-	partition                      int
-	inFlightMessageGroups          map[string][]*inFlightMessageGroup
-	commitNextInFlightMessageGroup bool
+// RebalanceNotification describes a consumer group rebalance event that a
+// partitionProcessorGroup observed. Users can read these off
+// TopicProcessor.RebalanceNotifications() to know when partition assignment
+// changed, e.g. to adjust external concurrency limits or emit metrics.
+type RebalanceNotification struct {
+	Claimed map[string][]int32
+	Member  sarama.GroupMemberDescription
+}
+
+// restorableStore is implemented by any KeyValueStore that can replay its
+// changelog to rebuild local state for a partition before it starts serving
+// Process calls, e.g. *kv.BoltDBKeyValueStore. Config.Stores lists the ones
+// Setup should restore on every (re)assignment.
+type restorableStore interface {
+	Restore(partition int32) error
 }
 
-func (pp *partitionProcessor) consumerMessageChannels() []<-chan *sarama.ConsumerMessage {
-	chans := make([]<-chan *sarama.ConsumerMessage, len(pp.partitionConsumers))
-	for i, consumer := range pp.partitionConsumers {
-		chans[i] = consumer.Messages()
+// partitionProcessorGroup is the sarama.ConsumerGroupHandler that backs a
+// TopicProcessor. It owns one partitionProcessor per assigned partition and
+// copartitions all of a TopicProcessor's input topics onto that single
+// partitionProcessor, so joins across input topics see a consistent
+// partition assignment.
+type partitionProcessorGroup struct {
+	topicProcessor *TopicProcessor
+
+	mu                  sync.Mutex
+	partitionProcessors map[int32]*partitionProcessor
+}
+
+// RebalanceNotifications returns the channel RebalanceNotification events are
+// delivered on, so callers can observe reassignment, e.g. to adjust external
+// concurrency limits or emit metrics.
+func (tp *TopicProcessor) RebalanceNotifications() <-chan RebalanceNotification {
+	return tp.rebalanceNotifications
+}
+
+func newPartitionProcessorGroup(tp *TopicProcessor) *partitionProcessorGroup {
+	return &partitionProcessorGroup{
+		topicProcessor:      tp,
+		partitionProcessors: make(map[int32]*partitionProcessor),
 	}
-	return chans
 }
 
-func newPartitionProcessor(tp *TopicProcessor, mp MessageProcessor, partition int) *partitionProcessor {
-	consumer, err := sarama.NewConsumerFromClient(tp.client)
-	if err != nil {
-		log.Fatal(err)
-	}
-	partitionConsumers := make([]sarama.PartitionConsumer, len(tp.inputTopics))
-	partitionOffsetManagers := make(map[string]sarama.PartitionOffsetManager)
-	for i, topic := range tp.inputTopics {
-		pom, err := tp.offsetManager.ManagePartition(string(topic), int32(partition))
-		if err != nil {
-			log.Fatal(err)
+// Setup is called by sarama at the start of a new consumer group session,
+// once partitions have been (re)assigned. For each assigned partition it
+// first restores every Config.Stores entry (e.g. a changelog-backed
+// *kv.BoltDBKeyValueStore) so local state is rebuilt before any message is
+// delivered for that partition, then builds a partitionProcessor,
+// copartitioning every input topic claimed for that partition onto it.
+func (g *partitionProcessorGroup) Setup(session sarama.ConsumerGroupSession) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	claims := session.Claims()
+	partitions := make(map[int32]bool)
+	for _, topicPartitions := range claims {
+		for _, partition := range topicPartitions {
+			partitions[partition] = true
 		}
-		newestOffset, err := tp.client.GetOffset(string(topic), int32(partition), sarama.OffsetNewest)
-		if err != nil {
-			log.Fatal(err)
+	}
+	for partition := range partitions {
+		for _, store := range g.topicProcessor.config.Stores {
+			if err := store.Restore(partition); err != nil {
+				return fmt.Errorf("could not restore store for partition %d: %s", partition, err)
+			}
 		}
-		nextOffset, _ := pom.NextOffset()
-		if nextOffset > newestOffset {
-			nextOffset = sarama.OffsetNewest
+		pp := newPartitionProcessor(g.topicProcessor, g.topicProcessor.messageProcessor, int(partition))
+		g.partitionProcessors[partition] = pp
+	}
+
+	select {
+	case g.topicProcessor.rebalanceNotifications <- RebalanceNotification{Claimed: claims}:
+	default:
+		log.Println("Dropping rebalance notification: no reader on RebalanceNotifications()")
+	}
+	return nil
+}
+
+// defaultDrainTimeout bounds how long Cleanup waits for in-flight message
+// groups to be acked before giving up on a partition, so a stuck producer
+// or broker can never hang a rebalance forever.
+const defaultDrainTimeout = 30 * time.Second
+
+// Cleanup is called at the end of a consumer group session, e.g. right
+// before a rebalance. It drains every still in-flight message group so no
+// acknowledged offsets are lost across the rebalance, then releases the
+// partitionProcessors for the partitions that are about to be revoked.
+// Partitions are drained concurrently so one stuck partition is bounded by
+// defaultDrainTimeout regardless of how many other partitions this member
+// holds, instead of multiplying the timeout by the partition count.
+func (g *partitionProcessorGroup) Cleanup(session sarama.ConsumerGroupSession) error {
+	g.mu.Lock()
+	partitionProcessors := g.partitionProcessors
+	g.partitionProcessors = make(map[int32]*partitionProcessor)
+	g.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(partitionProcessors))
+	for _, pp := range partitionProcessors {
+		go func(pp *partitionProcessor) {
+			defer wg.Done()
+			pp.drainInFlightMessageGroups(session, defaultDrainTimeout)
+			pp.onShutdown()
+		}(pp)
+	}
+	wg.Wait()
+	return nil
+}
+
+// ConsumeClaim consumes one partition of one input topic and feeds messages
+// into the partitionProcessor shared by every input topic claimed for that
+// partition.
+func (g *partitionProcessorGroup) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	g.mu.Lock()
+	pp := g.partitionProcessors[claim.Partition()]
+	g.mu.Unlock()
+
+	bounded := make(chan *sarama.ConsumerMessage, g.topicProcessor.config.Config.MaxInFlightMessageGroups)
+	go func() {
+		defer close(bounded)
+		for message := range claim.Messages() {
+			pp.waitUntilReadyForMessage(message)
+			bounded <- message
 		}
-		c, err := consumer.ConsumePartition(string(topic), int32(partition), nextOffset)
+	}()
+
+	for message := range bounded {
+		producerMessages, err := pp.processWithRetry(message)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		for _, producerMessage := range producerMessages {
+			g.topicProcessor.producer.Input() <- producerMessage
+		}
+		pp.mu.Lock()
+		pp.onProcessCompleted()
+		pp.markOffsetsIfPossible(session)
+		pp.reportMetrics(message.Topic, message.Offset, claim.HighWaterMarkOffset())
+		pp.mu.Unlock()
+	}
+	return nil
+}
+
+// reportMetrics publishes consumer lag (lastOffset, the offset of the message
+// just processed on topic, against the claim's broker-reported high water
+// mark) and the current in-flight-message-group backlog for topic to the
+// configured MetricsReporter. Caller must hold pp.mu.
+func (pp *partitionProcessor) reportMetrics(topic string, lastOffset int64, highWaterMark int64) {
+	reporter := pp.topicProcessor.metrics
+	if reporter == nil {
+		return
+	}
+	groups := pp.inFlightMessageGroups[topic]
+	reporter.ReportLag(topic, int32(pp.partition), highWaterMark-lastOffset-1)
+
+	var oldestAge time.Duration
+	if len(groups) > 0 {
+		oldestAge = time.Since(groups[0].incomingMessage.Timestamp)
+	}
+	reporter.ReportInFlightMessageGroups(topic, int32(pp.partition), len(groups), oldestAge)
+}
+
+// processWithRetry calls pp.process and, if it fails, consults
+// Config.ProcessorErrorHandler to decide whether to retry after backing
+// off, skip the message, or fail the partition the way unhandled errors
+// always used to: a Fail verdict is reported to Run through
+// pp.reportFatal, since returning an error from ConsumeClaim on its own
+// only ends that one claim - sarama logs it via group.Errors() and
+// continues the session - it does not stop Run's loop. It is a
+// self-locking entry point: it must NOT be called while already holding
+// pp.mu. pp is shared by every input topic copartitioned onto this
+// partition, so it only holds pp.mu around the actual pp.process call and
+// bookkeeping, releasing it before sleeping out a Retry backoff —
+// otherwise one topic backing off for up to 30s would also stall every
+// other copartitioned topic's ConsumeClaim loop, and
+// onProducerAck/onProducerError, which share the same lock.
+func (pp *partitionProcessor) processWithRetry(consumerMessage *sarama.ConsumerMessage) ([]*sarama.ProducerMessage, error) {
+	handler := pp.topicProcessor.config.ProcessorErrorHandler
+	if handler == nil {
+		handler = defaultProcessorErrorHandler
+	}
+	for {
+		pp.mu.Lock()
+		producerMessages, incomingMessage, err := pp.process(consumerMessage)
+		if err == nil {
+			pp.backoff.Reset()
+		}
+		pp.mu.Unlock()
+		if err == nil {
+			return producerMessages, nil
+		}
+
+		switch handler(incomingMessage, err) {
+		case Retry:
+			pp.mu.Lock()
+			duration := pp.backoff.Duration()
+			pp.mu.Unlock()
+			time.Sleep(duration)
+		case Skip:
+			pp.mu.Lock()
+			pp.backoff.Reset()
+			pp.markSkipped(consumerMessage, incomingMessage)
+			pp.mu.Unlock()
+			return nil, nil
+		default:
+			pp.reportFatal(err)
+			return nil, err
 		}
-		partitionConsumers[i] = c
-		partitionOffsetManagers[topic] = pom
 	}
+}
+
+// reportFatal delivers a Fail-verdict error to Run over tp.fatalErrors so
+// Run actually stops the TopicProcessor, the way the old log.Fatal
+// behaviour did, instead of this partition simply being reassigned and
+// probably hitting the same failure again. Only the first fatal error is
+// kept; later ones are dropped since Run is already shutting down. Safe to
+// call without holding pp.mu.
+func (pp *partitionProcessor) reportFatal(err error) {
+	select {
+	case pp.topicProcessor.fatalErrors <- err:
+	default:
+	}
+}
+
+// markSkipped synthesizes an already-acked in-flight message group for a
+// skipped message, the same way process would have if it had succeeded.
+// Without this, a Skip verdict leaves no record of the message's offset at
+// all, so if it was the newest one on its topic markOffsetsForTopicIfPossible
+// has nothing to walk and the offset never advances past it — the same
+// "skipped" message gets redelivered and skipped again on every rebalance or
+// restart. Caller must hold pp.mu.
+func (pp *partitionProcessor) markSkipped(consumerMessage *sarama.ConsumerMessage, incomingMessage IncomingMessage) {
+	group := &inFlightMessageGroup{
+		incomingMessage: &incomingMessage,
+		committed:       true,
+	}
+	pp.inFlightMessageGroups[consumerMessage.Topic] = append(
+		pp.inFlightMessageGroups[consumerMessage.Topic],
+		group,
+	)
+}
+
+// partitionProcessor's mutable state (inFlightMessageGroups,
+// commitNextInFlightMessageGroup, backoff) is shared by every input topic
+// copartitioned onto it: one ConsumeClaim goroutine per claimed topic, that
+// topic's own feeder goroutine, and the producer's ack/error callbacks all
+// touch it concurrently. Every method below that reads or writes that state
+// requires mu to be held by the caller, except onProducerAck,
+// onProducerError, waitUntilReadyForMessage, drainInFlightMessageGroups and
+// processWithRetry, which are self-locking entry points invoked from outside
+// the ConsumeClaim loop (or, for processWithRetry, must not be called while
+// already holding mu).
+type partitionProcessor struct {
+	topicProcessor                 *TopicProcessor
+	coordinator                    Coordinator
+	messageProcessor               MessageProcessor
+	inputTopics                    []string
+	partition                      int
+	mu                             sync.Mutex
+	inFlightMessageGroups          map[string][]*inFlightMessageGroup
+	commitNextInFlightMessageGroup bool
+	backoff                        *simpleBackoff
+}
+
+func newPartitionProcessor(tp *TopicProcessor, mp MessageProcessor, partition int) *partitionProcessor {
 	pp := &partitionProcessor{
-		tp,
-		nil,
-		consumer,
-		partitionConsumers,
-		partitionOffsetManagers,
-		mp,
-		tp.inputTopics,
-		partition,
-		make(map[string][]*inFlightMessageGroup),
-		false,
+		topicProcessor:        tp,
+		messageProcessor:      mp,
+		inputTopics:           tp.inputTopicsSnapshot(),
+		partition:             partition,
+		inFlightMessageGroups: make(map[string][]*inFlightMessageGroup),
+		backoff:               newSimpleBackoff(100*time.Millisecond, 30*time.Second),
 	}
 	pp.coordinator = &partitionProcessorCoordinator{pp}
 	return pp
 }
 
-func (pp *partitionProcessor) process(consumerMessage *sarama.ConsumerMessage) []*sarama.ProducerMessage {
-	topicSerde, ok := pp.topicProcessor.config.TopicSerdes[string(consumerMessage.Topic)]
-	if !ok {
-		log.Fatalf("Could not find Serde for topic '%s'", consumerMessage.Topic)
-	}
+// process deserializes consumerMessage and runs it through the
+// MessageProcessor. Both the missing-Serde lookup and a
+// MessageProcessor.Process error are returned instead of log.Fatal-ing, so
+// the caller can apply Config.ProcessorErrorHandler's retry/skip/fail
+// policy to either one. Caller must hold pp.mu.
+func (pp *partitionProcessor) process(consumerMessage *sarama.ConsumerMessage) ([]*sarama.ProducerMessage, IncomingMessage, error) {
 	incomingMessage := IncomingMessage{
 		Topic:     consumerMessage.Topic,
 		Partition: int(consumerMessage.Partition),
 		Offset:    consumerMessage.Offset,
-		Key:       topicSerde.KeySerde.Deserialize(consumerMessage.Key),
-		Value:     topicSerde.ValueSerde.Deserialize(consumerMessage.Value),
 		Timestamp: consumerMessage.Timestamp,
 	}
+	topicSerde, ok := pp.topicProcessor.config.TopicSerdes[string(consumerMessage.Topic)]
+	if !ok {
+		return nil, incomingMessage, fmt.Errorf("could not find Serde for topic '%s'", consumerMessage.Topic)
+	}
+	incomingMessage.Key = topicSerde.KeySerde.Deserialize(consumerMessage.Key)
+	incomingMessage.Value = topicSerde.ValueSerde.Deserialize(consumerMessage.Value)
 	sender := newSender(pp, &incomingMessage)
 	pp.commitNextInFlightMessageGroup = false
-	pp.messageProcessor.Process(incomingMessage, sender, pp.coordinator)
+	if err := pp.messageProcessor.Process(incomingMessage, sender, pp.coordinator); err != nil {
+		return nil, incomingMessage, fmt.Errorf("could not process message from '%s': %s", consumerMessage.Topic, err)
+	}
 	inFlightMessageGroup := sender.createInFlightMessageGroup(pp.commitNextInFlightMessageGroup)
 	pp.inFlightMessageGroups[consumerMessage.Topic] = append(
 		pp.inFlightMessageGroups[consumerMessage.Topic],
 		inFlightMessageGroup,
 	)
-	return sender.producerMessages
+	return sender.producerMessages, incomingMessage, nil
 }
 
+// onProcessCompleted prunes fully-acked in-flight message groups. Caller
+// must hold pp.mu.
 func (pp *partitionProcessor) onProcessCompleted() {
 	pp.pruneInFlightMessageGroups()
 }
 
+// pruneInFlightMessageGroups must be called with pp.mu held.
 func (pp *partitionProcessor) pruneInFlightMessageGroups() {
-	for _, topic := range pp.topicProcessor.inputTopics {
+	for _, topic := range pp.inputTopics {
 		pp.pruneInFlightMessageGroupsForTopic(topic)
 	}
 }
 
+// pruneInFlightMessageGroupsForTopic must be called with pp.mu held.
 func (pp *partitionProcessor) pruneInFlightMessageGroupsForTopic(topic string) {
 	for len(pp.inFlightMessageGroups[topic]) > 1 {
 		headGroup := pp.inFlightMessageGroups[topic][0]
@@ -115,18 +342,79 @@ func (pp *partitionProcessor) pruneInFlightMessageGroupsForTopic(topic string) {
 	}
 }
 
+// drainInFlightMessageGroups waits for every in-flight message group on
+// this partition to be acked, reusing markOffsetsForTopicIfPossible so the
+// offsets they protect are actually committed to session rather than just
+// discarded, up to timeout. It gives up and logs any topic still undrained
+// after timeout so a stuck producer/broker can never hang a rebalance
+// forever. It is a self-locking entry point, safe to call without already
+// holding pp.mu.
+func (pp *partitionProcessor) drainInFlightMessageGroups(session sarama.ConsumerGroupSession, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, topic := range pp.inputTopics {
+		for {
+			pp.mu.Lock()
+			pp.markOffsetsForTopicIfPossible(topic, session)
+			remaining := len(pp.inFlightMessageGroups[topic])
+			pp.mu.Unlock()
+
+			if remaining == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Printf(
+					"kasper: gave up draining %d in-flight message group(s) for topic '%s' partition %d after %s",
+					remaining, topic, pp.partition, timeout,
+				)
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// isReadyForMessage must be called with pp.mu held.
 func (pp *partitionProcessor) isReadyForMessage(msg *sarama.ConsumerMessage) bool {
 	maxGroups := pp.topicProcessor.config.Config.MaxInFlightMessageGroups
 	return len(pp.inFlightMessageGroups[msg.Topic]) <= maxGroups
 }
 
-func (pp *partitionProcessor) markOffsetsIfPossible() {
-	for _, topic := range pp.topicProcessor.inputTopics {
-		pp.markOffsetsForTopicIfPossible(topic)
+// waitUntilReadyPollInterval bounds how long waitUntilReadyForMessage sleeps
+// between readiness checks, so a slow downstream applies backpressure
+// without pegging a CPU core busy-spinning on pp.mu.
+const waitUntilReadyPollInterval = 50 * time.Millisecond
+
+// waitUntilReadyForMessage blocks until enough in-flight message groups for
+// msg's topic have been acked to accept another one, applying backpressure
+// to the consumer group session instead of growing inFlightMessageGroups
+// without bound. It is a self-locking entry point: it must NOT be called
+// while already holding pp.mu, since it is invoked from each topic's own
+// feeder goroutine, concurrently with the ConsumeClaim goroutines that hold
+// pp.mu while processing.
+func (pp *partitionProcessor) waitUntilReadyForMessage(msg *sarama.ConsumerMessage) {
+	for {
+		pp.mu.Lock()
+		ready := pp.isReadyForMessage(msg)
+		if !ready {
+			pp.pruneInFlightMessageGroupsForTopic(msg.Topic)
+		}
+		pp.mu.Unlock()
+		if ready {
+			return
+		}
+		time.Sleep(waitUntilReadyPollInterval)
 	}
 }
 
-func (pp *partitionProcessor) markOffsetsForTopicIfPossible(topic string) {
+// markOffsetsIfPossible must be called with pp.mu held.
+func (pp *partitionProcessor) markOffsetsIfPossible(session sarama.ConsumerGroupSession) {
+	for _, topic := range pp.inputTopics {
+		pp.markOffsetsForTopicIfPossible(topic, session)
+	}
+}
+
+// markOffsetsForTopicIfPossible must be called with pp.mu held.
+func (pp *partitionProcessor) markOffsetsForTopicIfPossible(topic string, session sarama.ConsumerGroupSession) {
 	var offset int64 = -1
 	for len(pp.inFlightMessageGroups[topic]) > 0 {
 		group := pp.inFlightMessageGroups[topic][0]
@@ -135,18 +423,22 @@ func (pp *partitionProcessor) markOffsetsForTopicIfPossible(topic string) {
 		}
 		offset = group.incomingMessage.Offset
 		if group.committed && pp.topicProcessor.config.markOffsetsManually() {
-			offsetManager := pp.offsetManagers[topic]
-			offsetManager.MarkOffset(offset+1, "")
+			session.MarkOffset(topic, int32(pp.partition), offset+1, "")
 		}
 		pp.inFlightMessageGroups[topic] = pp.inFlightMessageGroups[topic][1:]
 	}
 	if offset != -1 && pp.topicProcessor.config.markOffsetsAutomatically() {
-		offsetManager := pp.offsetManagers[topic]
-		offsetManager.MarkOffset(offset+1, "")
+		session.MarkOffset(topic, int32(pp.partition), offset+1, "")
 	}
 }
 
+// onProducerAck is a self-locking entry point: it is invoked from the
+// producer's own ack-handling goroutine, independently of whichever
+// ConsumeClaim goroutine is currently holding pp.mu.
 func (pp *partitionProcessor) onProducerAck(sentMessage *sarama.ProducerMessage) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
 	incomingMessage := sentMessage.Metadata.(*IncomingMessage)
 	foundGroup := false
 	for _, group := range pp.inFlightMessageGroups[incomingMessage.Topic] {
@@ -163,6 +455,9 @@ func (pp *partitionProcessor) onProducerAck(sentMessage *sarama.ProducerMessage)
 			if !foundMsg {
 				log.Fatal("Could not find producer message in inFlightMessageGroups")
 			}
+			if reporter := pp.topicProcessor.metrics; reporter != nil && !sentMessage.Timestamp.IsZero() {
+				reporter.ReportProduceAckLatency(sentMessage.Topic, time.Since(sentMessage.Timestamp))
+			}
 			break
 		}
 	}
@@ -171,12 +466,59 @@ func (pp *partitionProcessor) onProducerAck(sentMessage *sarama.ProducerMessage)
 	}
 }
 
-func (pp *partitionProcessor) onShutdown() {
-	for _, pom := range pp.offsetManagers {
-		pom.Close()
+// onProducerError is the error-path counterpart to onProducerAck: a
+// self-locking entry point invoked from the producer's own error-handling
+// goroutine whenever a produced message comes back failed instead of acked.
+// It applies Config.ProcessorErrorHandler the same Retry/Skip/Fail policy
+// processWithRetry applies to Process errors, so a flaky downstream (ES,
+// another Kafka topic) is governed by that policy instead of the failure
+// being silently dropped and the in-flight message group hanging forever. A
+// Fail verdict is reported to Run through pp.reportFatal, same as
+// processWithRetry.
+func (pp *partitionProcessor) onProducerError(sentMessage *sarama.ProducerMessage, sendErr error) {
+	incomingMessage := sentMessage.Metadata.(*IncomingMessage)
+
+	pp.mu.Lock()
+	foundGroup := false
+	var ackedMessage *inFlightMessage
+	for _, group := range pp.inFlightMessageGroups[incomingMessage.Topic] {
+		if group.incomingMessage != incomingMessage {
+			continue
+		}
+		foundGroup = true
+		for _, inFlight := range group.inFlightMessages {
+			if inFlight.msg == sentMessage {
+				ackedMessage = inFlight
+				break
+			}
+		}
+		break
 	}
-	for _, pc := range pp.partitionConsumers {
-		pc.Close()
+	pp.mu.Unlock()
+	if !foundGroup || ackedMessage == nil {
+		log.Fatal("Could not find producer message in inFlightMessageGroups")
 	}
-	pp.consumer.Close()
+
+	handler := pp.topicProcessor.config.ProcessorErrorHandler
+	if handler == nil {
+		handler = defaultProcessorErrorHandler
+	}
+	switch handler(*incomingMessage, sendErr) {
+	case Retry:
+		pp.mu.Lock()
+		duration := pp.backoff.Duration()
+		pp.mu.Unlock()
+		time.Sleep(duration)
+		pp.topicProcessor.producer.Input() <- sentMessage
+	case Skip:
+		pp.mu.Lock()
+		ackedMessage.ack = true
+		pp.backoff.Reset()
+		pp.mu.Unlock()
+	default:
+		pp.reportFatal(fmt.Errorf("giving up on produced message to topic '%s': %s", sentMessage.Topic, sendErr))
+	}
+}
+
+func (pp *partitionProcessor) onShutdown() {
 }
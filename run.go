@@ -0,0 +1,93 @@
+package kasper
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Shopify/sarama"
+)
+
+// Run builds a sarama.ConsumerGroup from tp.client and consumes
+// tp.inputTopics with it until ctx is cancelled. sarama.ConsumerGroup.Consume
+// returns at the end of every rebalance, so Run calls it again in a loop;
+// that loop is what keeps the TopicProcessor attached to the group across
+// every subsequent rebalance until ctx is cancelled or the group is closed.
+//
+// Run also defaults tp.metrics to a prometheusMetricsReporter if the caller
+// hasn't set one, and, if Config.MetricsAddr is non-empty, calls
+// ServeMetrics in a background goroutine, which serves it over HTTP only
+// when it is that default Prometheus reporter. It starts
+// topicDiscovery's background refresh loop (a no-op unless Config.TopicPattern
+// is set) and stops it when Run returns.
+//
+// A Fail verdict from Config.ProcessorErrorHandler is reported on
+// tp.fatalErrors rather than by returning an error from ConsumeClaim, since
+// sarama only logs a ConsumeClaim error via group.Errors() and continues
+// the session — it does not stop the consumer group. Run watches
+// tp.fatalErrors and cancels its own context as soon as one arrives, so a
+// Fail verdict actually stops the TopicProcessor instead of the same
+// partition simply being reassigned and probably hitting the same failure
+// again.
+func (tp *TopicProcessor) Run(ctx context.Context) error {
+	group, err := sarama.NewConsumerGroupFromClient(tp.config.Config.GroupID, tp.client)
+	if err != nil {
+		return fmt.Errorf("could not create consumer group: %s", err)
+	}
+	tp.consumerGroup = group
+	defer group.Close()
+
+	if tp.metrics == nil {
+		tp.metrics = newPrometheusMetricsReporter()
+	}
+	if addr := tp.config.MetricsAddr; addr != "" {
+		go func() {
+			if err := tp.ServeMetrics(addr); err != nil {
+				log.Printf("kasper: metrics server on %s failed: %s", addr, err)
+			}
+		}()
+	}
+
+	discovery := newTopicDiscovery(tp)
+	go discovery.run()
+	defer discovery.close()
+
+	if tp.fatalErrors == nil {
+		tp.fatalErrors = make(chan error, 1)
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fatalErrCh := make(chan error, 1)
+	go func() {
+		select {
+		case err := <-tp.fatalErrors:
+			fatalErrCh <- err
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
+
+	handler := newPartitionProcessorGroup(tp)
+
+	go func() {
+		for err := range group.Errors() {
+			log.Printf("kasper: consumer group error: %s", err)
+		}
+	}()
+
+	for runCtx.Err() == nil {
+		// inputTopics is read here on every loop iteration, concurrently with
+		// topicDiscovery's refresh goroutine swapping it out under
+		// inputTopicsMu, so it must go through inputTopicsSnapshot rather
+		// than a direct field read.
+		if err := group.Consume(runCtx, tp.inputTopicsSnapshot(), handler); err != nil {
+			return fmt.Errorf("consumer group session failed: %s", err)
+		}
+	}
+	select {
+	case err := <-fatalErrCh:
+		return fmt.Errorf("processor failed: %s", err)
+	default:
+	}
+	return ctx.Err()
+}
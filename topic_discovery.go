@@ -0,0 +1,116 @@
+package kasper
+
+import (
+	"log"
+	"regexp"
+	"time"
+)
+
+// defaultTopicDiscoveryInterval is how often the topic discovery loop polls
+// the cluster metadata for topics matching Config.TopicPattern when no
+// TopicDiscoveryInterval is configured.
+const defaultTopicDiscoveryInterval = 1 * time.Minute
+
+// topicDiscovery periodically matches Config.TopicPattern against the
+// cluster's topic list and keeps TopicProcessor.inputTopics in sync, so
+// consumers written against a pattern (e.g. "events.*") pick up newly
+// provisioned topics without a restart.
+type topicDiscovery struct {
+	topicProcessor *TopicProcessor
+	stop           chan struct{}
+}
+
+func newTopicDiscovery(tp *TopicProcessor) *topicDiscovery {
+	return &topicDiscovery{
+		topicProcessor: tp,
+		stop:           make(chan struct{}),
+	}
+}
+
+func (d *topicDiscovery) run() {
+	pattern := d.topicProcessor.config.TopicPattern
+	if pattern == nil {
+		return
+	}
+	interval := d.topicProcessor.config.TopicDiscoveryInterval
+	if interval == 0 {
+		interval = defaultTopicDiscoveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.refresh(pattern)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *topicDiscovery) refresh(pattern *regexp.Regexp) {
+	topics, err := d.topicProcessor.client.Topics()
+	if err != nil {
+		log.Printf("Could not refresh topic metadata: %s", err)
+		return
+	}
+	matched := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if pattern.MatchString(topic) {
+			matched = append(matched, topic)
+		}
+	}
+	d.topicProcessor.updateInputTopics(matched)
+}
+
+func (d *topicDiscovery) close() {
+	close(d.stop)
+}
+
+// updateInputTopics swaps in a freshly discovered set of input topics. If
+// the set actually changed, it asks the consumer group to rejoin so sarama
+// re-subscribes to the new topic list and rebalances partitions across it.
+//
+// tp.inputTopics itself must only ever be read through inputTopicsSnapshot
+// (as Run does before every group.Consume call and newPartitionProcessor
+// does during Setup) — never directly — since this method mutates it
+// concurrently from the discovery goroutine.
+func (tp *TopicProcessor) updateInputTopics(topics []string) {
+	tp.inputTopicsMu.Lock()
+	defer tp.inputTopicsMu.Unlock()
+	if !mustRebalance(tp.inputTopics, topics) {
+		return
+	}
+	log.Printf("Topic discovery: input topics changed from %v to %v", tp.inputTopics, topics)
+	tp.inputTopics = topics
+	tp.triggerRejoin()
+}
+
+// inputTopicsSnapshot returns a copy of tp.inputTopics, safe to call
+// concurrently with updateInputTopics.
+func (tp *TopicProcessor) inputTopicsSnapshot() []string {
+	tp.inputTopicsMu.Lock()
+	defer tp.inputTopicsMu.Unlock()
+	topics := make([]string, len(tp.inputTopics))
+	copy(topics, tp.inputTopics)
+	return topics
+}
+
+// mustRebalance reports whether newTopics differs from the currently
+// subscribed input topics and therefore requires rejoining the consumer
+// group so sarama picks up the new subscription set.
+func mustRebalance(current []string, newTopics []string) bool {
+	if len(current) != len(newTopics) {
+		return true
+	}
+	seen := make(map[string]bool, len(current))
+	for _, topic := range current {
+		seen[topic] = true
+	}
+	for _, topic := range newTopics {
+		if !seen[topic] {
+			return true
+		}
+	}
+	return false
+}
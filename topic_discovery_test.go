@@ -0,0 +1,26 @@
+package kasper
+
+import "testing"
+
+func TestMustRebalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		current []string
+		next    []string
+		want    bool
+	}{
+		{"identical", []string{"a", "b"}, []string{"a", "b"}, false},
+		{"reordered", []string{"a", "b"}, []string{"b", "a"}, false},
+		{"topic added", []string{"a"}, []string{"a", "b"}, true},
+		{"topic removed", []string{"a", "b"}, []string{"a"}, true},
+		{"topic replaced", []string{"a", "b"}, []string{"a", "c"}, true},
+		{"both empty", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustRebalance(tt.current, tt.next); got != tt.want {
+				t.Errorf("mustRebalance(%v, %v) = %v, want %v", tt.current, tt.next, got, tt.want)
+			}
+		})
+	}
+}